@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Executor runs a hook's resolved command somewhere: on the local host,
+// inside a container, or on a remote host over SSH. This lets hook logic
+// be isolated from the daemon's own host when it shouldn't be trusted
+// with direct access to it.
+type Executor interface {
+	// Run executes args with env and dir, writing combined stdout/stderr
+	// to out, and returns the exit code. timedOut is true if the command
+	// had to be killed, either for exceeding timeout or because ctx was
+	// canceled, in which case exitCode is meaningless.
+	Run(ctx context.Context, args []string, env []string, dir string, timeout time.Duration, out io.Writer) (exitCode int, timedOut bool, err error)
+}
+
+// executorFor returns the Executor named by hook.Executor, defaulting to
+// the local executor when it's unset.
+func (hook *Hook) executorFor() (Executor, error) {
+	switch hook.Executor {
+	case "", "local":
+		return localExecutor{}, nil
+	case "docker":
+		return dockerExecutor{Image: hook.Image, Volumes: hook.Volumes, Network: hook.Network}, nil
+	case "ssh":
+		return sshExecutor{Host: hook.Host, User: hook.User, KeyFile: hook.KeyFile, HostKeyFile: hook.HostKeyFile}, nil
+	default:
+		return nil, fmt.Errorf("unknown executor %q", hook.Executor)
+	}
+}
+
+// localExecutor runs the command directly on the host, as unwebhook always
+// did before the Executor interface existed.
+type localExecutor struct{}
+
+func (localExecutor) Run(ctx context.Context, args []string, env []string, dir string, timeout time.Duration, out io.Writer) (int, bool, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	if len(env) != 0 {
+		cmd.Env = env
+	}
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	return runWithTimeout(ctx, cmd, timeout)
+}
+
+// dockerExecutor runs the command inside a container via the docker CLI,
+// mirroring how CI runners like Woodpecker/Drone dispatch build steps.
+type dockerExecutor struct {
+	Image   string
+	Volumes []string
+	Network string
+}
+
+func (e dockerExecutor) Run(ctx context.Context, args []string, env []string, dir string, timeout time.Duration, out io.Writer) (int, bool, error) {
+	dockerArgs := []string{"run", "--rm"}
+
+	if dir != "" {
+		dockerArgs = append(dockerArgs, "-w", dir)
+	}
+	for _, volume := range e.Volumes {
+		dockerArgs = append(dockerArgs, "-v", volume)
+	}
+	if e.Network != "" {
+		dockerArgs = append(dockerArgs, "--network", e.Network)
+	}
+	for _, kv := range env {
+		dockerArgs = append(dockerArgs, "-e", kv)
+	}
+	dockerArgs = append(dockerArgs, e.Image)
+	dockerArgs = append(dockerArgs, args...)
+
+	cmd := exec.Command("docker", dockerArgs...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	return runWithTimeout(ctx, cmd, timeout)
+}
+
+// runWithTimeout starts cmd and waits for it, killing it if timeout
+// elapses first. Shared by the executors that run a local *exec.Cmd.
+func runWithTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) (int, bool, error) {
+	if err := cmd.Start(); err != nil {
+		return -1, false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	select {
+	case <-done:
+		timer.Stop()
+		return cmd.ProcessState.ExitCode(), false, nil
+	case <-timer.C:
+		cmd.Process.Kill()
+		return -1, true, fmt.Errorf("command timed out")
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return -1, true, fmt.Errorf("command killed: %s", ctx.Err())
+	}
+}
+
+// sshExecutor runs the command on a remote host over SSH, authenticating
+// with a private key file and verifying Host against a known_hosts file.
+// Unlike localExecutor and dockerExecutor, the command runs through the
+// remote login shell rather than being exec'd directly, since ssh.Session
+// only takes a single command string; each arg is shell-quoted before
+// joining so event-derived values can't break out of their argument.
+type sshExecutor struct {
+	Host        string
+	User        string
+	KeyFile     string
+	HostKeyFile string
+}
+
+func (e sshExecutor) Run(ctx context.Context, args []string, env []string, dir string, timeout time.Duration, out io.Writer) (int, bool, error) {
+	key, err := os.ReadFile(e.KeyFile)
+	if err != nil {
+		return -1, false, fmt.Errorf("reading SSH key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return -1, false, fmt.Errorf("parsing SSH key: %s", err)
+	}
+
+	if e.HostKeyFile == "" {
+		return -1, false, fmt.Errorf("HostKeyFile is required for the ssh executor")
+	}
+	hostKeyCallback, err := knownhosts.New(e.HostKeyFile)
+	if err != nil {
+		return -1, false, fmt.Errorf("loading known_hosts file %s: %s", e.HostKeyFile, err)
+	}
+
+	client, err := ssh.Dial("tcp", e.Host, &ssh.ClientConfig{
+		User:            e.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		return -1, false, fmt.Errorf("dialing %s: %s", e.Host, err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, false, fmt.Errorf("opening SSH session: %s", err)
+	}
+	defer session.Close()
+
+	for _, kv := range env {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			session.Setenv(key, value)
+		}
+	}
+
+	session.Stdout = out
+	session.Stderr = out
+
+	quotedArgs := make([]string, len(args))
+	for i, arg := range args {
+		quotedArgs[i] = shellQuote(arg)
+	}
+	command := strings.Join(quotedArgs, " ")
+	if dir != "" {
+		command = fmt.Sprintf("cd %s && %s", shellQuote(dir), command)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+
+	timer := time.NewTimer(timeout)
+	select {
+	case err := <-done:
+		timer.Stop()
+		if err == nil {
+			return 0, false, nil
+		}
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return exitErr.ExitStatus(), false, nil
+		}
+		return -1, false, err
+	case <-timer.C:
+		session.Signal(ssh.SIGKILL)
+		return -1, true, fmt.Errorf("command timed out")
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		return -1, true, fmt.Errorf("command killed: %s", ctx.Err())
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/dimfeld/glog"
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -67,15 +69,30 @@ func (hook *Hook) CreateTemplates() error {
 		hook.dirTemplate = nil
 	}
 
+	if hook.LogFile != "" {
+		hook.logFileTemplate, err = createTemplate(hook.LogFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		hook.logFileTemplate = nil
+	}
+
 	return nil
 }
 
-// Execute a hook with the given event.
-func (hook *Hook) Execute(e Event) {
+// Execute a hook with the given event. requestID correlates the resulting
+// log lines back to the incoming webhook request. ctx is canceled if the
+// server is forced to kill in-flight commands during shutdown. attempt is
+// 0 for a fresh request and counts up on each retry scheduled by
+// maybeRetry, so that Hook.MaxRetries can be enforced.
+func (hook *Hook) Execute(ctx context.Context, e Event, requestID string, attempt int) {
+	log := logger.With(append([]any{"request_id", requestID, "hook.url", hook.Url}, eventFields(e)...)...)
+
 	if len(hook.AllowEvent) != 0 {
 		eventType, ok := e["type"].(string)
 		if !ok {
-			glog.Warningf("Received non-string event type %T: %v", eventType, eventType)
+			log.Warn("Received non-string event type", "type", fmt.Sprintf("%T", eventType))
 			return
 		}
 
@@ -88,14 +105,14 @@ func (hook *Hook) Execute(e Event) {
 		}
 
 		if !allowed {
-			glog.Warningf("Hook %s got disallowed event type %s\n", hook.Url, eventType)
+			log.Warn("Hook got disallowed event type", "event.type", eventType)
 			return
 		}
 	}
 	if len(hook.AllowPipelineStatus) != 0 {
 		pipelineStatus, ok := e["status"].(string)
 		if !ok {
-			glog.Warningf("Received non-string Pipeline Status %T: %v", pipelineStatus, pipelineStatus)
+			log.Warn("Received non-string pipeline status", "type", fmt.Sprintf("%T", pipelineStatus))
 			return
 		}
 
@@ -108,7 +125,7 @@ func (hook *Hook) Execute(e Event) {
 		}
 
 		if !allowed {
-			glog.Infof("Hook %s called for incorrect pipeline status %s\n", hook.Url, pipelineStatus)
+			log.Info("Hook called for incorrect pipeline status", "status", pipelineStatus)
 			return
 		}
 	}
@@ -116,7 +133,7 @@ func (hook *Hook) Execute(e Event) {
 	if len(hook.AllowBranches) != 0 {
 		ref, ok := e["ref"].(string)
 		if !ok {
-			glog.Warningf("Received non-string ref type %T: %v", ref, ref)
+			log.Warn("Received non-string ref type", "type", fmt.Sprintf("%T", ref))
 			return
 		}
 
@@ -138,46 +155,54 @@ func (hook *Hook) Execute(e Event) {
 			// This is just an Info, not a warning, since there's no way
 			// to configure Github or Gitlab to only send events for certain
 			// branches.
-			glog.Infof("Hook %s called for ignored branch %s\n", hook.Url, ref)
+			log.Info("Hook called for ignored branch", "ref", ref)
 			return
 		}
 	}
 
 	if hook.PerCommit {
+		// A retry carries the commit it was scheduled for in e["commit"];
+		// only that commit is run again.
+		var retryCommit map[string]interface{}
+		if attempt > 0 {
+			retryCommit, _ = e["commit"].(map[string]interface{})
+		}
+
 		commits := e.Commits()
 		if commits != nil {
 			for _, generic := range commits {
 				c, ok := generic.(map[string]interface{})
 				if !ok {
-					glog.Errorf("Commit had type %T", generic)
+					log.Error("Commit had unexpected type", "type", fmt.Sprintf("%T", generic))
+					continue
+				}
+				if retryCommit != nil && fmt.Sprint(c["id"]) != fmt.Sprint(retryCommit["id"]) {
 					continue
 				}
 
 				// Set the current commit to pass to the hook.
 				e["commit"] = c
 
-				err := hook.processEvent(e)
+				exitCode, timedOut, err := hook.processEvent(ctx, e, requestID)
 				if err != nil {
-					glog.Errorf("Error processing %s: %s\n", hook.Url, err)
-					if glog.V(1) {
-						glog.Info(e)
-					}
+					log.Error("Error processing event", "commit.sha", c["id"], "error", err)
 				}
+				hook.maybeRetry(e, requestID, attempt, exitCode, timedOut, err)
 			}
 		}
 	} else {
-		err := hook.processEvent(e)
+		exitCode, timedOut, err := hook.processEvent(ctx, e, requestID)
 		if err != nil {
-			glog.Errorf("Error processing %s: %s\n", hook.Url, err)
-			if glog.V(1) {
-				glog.Info(e)
-			}
+			log.Error("Error processing event", "error", err)
 		}
+		hook.maybeRetry(e, requestID, attempt, exitCode, timedOut, err)
 	}
 }
 
-func (hook *Hook) processEvent(e Event) error {
-	var err error
+// processEvent runs hook's commands for e, returning the exit code and
+// timeout state of the last command that ran so the caller can decide
+// whether a retry applies.
+func (hook *Hook) processEvent(ctx context.Context, e Event, requestID string) (exitCode int, timedOut bool, err error) {
 	cmds := make([][]string, len(hook.cmdTemplate))
 	env := make([]string, len(hook.envTemplate))
 	dir := ""
@@ -187,7 +212,7 @@ func (hook *Hook) processEvent(e Event) error {
 		err = hook.dirTemplate.Execute(buf, e)
 		dir = string(buf.Bytes())
 		if err != nil {
-			return err
+			return 0, false, err
 		}
 	}
 
@@ -197,32 +222,40 @@ func (hook *Hook) processEvent(e Event) error {
 			err = t.Execute(buf, e)
 			env[i] = string(buf.Bytes())
 			if err != nil {
-				return err
+				return 0, false, err
 			}
 		}
 	}
 
+	local := hook.Executor == "" || hook.Executor == "local"
 	for i, t := range hook.cmdTemplate {
 		cmds[i], err = hook.processCommand(e, t)
 		if err != nil {
-			return err
+			return 0, false, err
 		}
 
-		execPath, err := exec.LookPath(cmds[i][0])
-		if err != nil {
-			return fmt.Errorf("Executable %s %s", cmds[i][0], err)
+		if local {
+			execPath, err := exec.LookPath(cmds[i][0])
+			if err != nil {
+				return 0, false, fmt.Errorf("Executable %s %s", cmds[i][0], err)
+			}
+			cmds[i][0] = execPath
 		}
-		cmds[i][0] = execPath
+	}
+
+	logPath, err := hook.renderLogFile(e)
+	if err != nil {
+		return 0, false, err
 	}
 
 	for _, cmd := range cmds {
-		err := hook.runCommand(cmd, env, dir)
+		exitCode, timedOut, err = hook.runCommand(ctx, cmd, env, dir, requestID, logPath)
 		if err != nil {
-			return err
+			return exitCode, timedOut, err
 		}
 	}
 
-	return nil
+	return exitCode, timedOut, nil
 }
 
 func (hook *Hook) processCommand(e Event, templateList []*template.Template) ([]string, error) {
@@ -242,35 +275,46 @@ func (hook *Hook) processCommand(e Event, templateList []*template.Template) ([]
 	return cmdList, nil
 }
 
-func (hook *Hook) runCommand(args []string, env []string, dir string) error {
-	glog.Infoln("Running", args)
-	cmd := exec.Command(args[0], args[1:]...)
-	if len(env) != 0 {
-		cmd.Env = env
-	}
-	cmd.Dir = dir
-	// TODO Make these redirectable
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func (hook *Hook) runCommand(ctx context.Context, args []string, env []string, dir string, requestID string, logPath string) (int, bool, error) {
+	log := logger.With("request_id", requestID, "hook.url", hook.Url)
+	log.Info("Running command", "args", args, "executor", hook.Executor)
 
-	done := make(chan int, 1)
-
-	cmd.Start()
-	go func() {
-		cmd.Wait()
-		done <- 1
-	}()
+	var writers []io.Writer
+	if logPath != "" {
+		logFile, err := openHookLog(logPath)
+		if err != nil {
+			log.Error("Could not open hook log file", "path", logPath, "error", err)
+		} else {
+			defer logFile.Close()
+			writers = append(writers, logFile)
+		}
+	}
+	if logHookOutput || len(writers) == 0 {
+		writers = append(writers, os.Stdout)
+	}
+	out := io.MultiWriter(writers...)
 
-	timer := time.NewTimer(time.Duration(hook.Timeout) * time.Second)
+	executor, err := hook.executorFor()
+	if err != nil {
+		return 0, false, err
+	}
 
-	select {
-	case <-done:
-		timer.Stop()
-		return nil
+	start := time.Now()
+	exitCode, timedOut, err := executor.Run(ctx, args, env, dir, time.Duration(hook.Timeout)*time.Second, out)
+	duration := time.Since(start)
 
-	case <-timer.C:
-		cmd.Process.Kill()
-		return fmt.Errorf("Command %v timed out", args)
+	if timedOut {
+		log.Error("Command timed out", "args", args, "duration_ms", duration.Milliseconds())
+		hookExecutionSeconds.WithLabelValues(hook.Url, "timeout").Observe(duration.Seconds())
+		commandTimeoutsTotal.Inc()
+		return exitCode, true, fmt.Errorf("Command %v timed out", args)
+	}
+	if err != nil {
+		log.Error("Command failed to run", "args", args, "error", err)
+		return exitCode, false, err
 	}
 
+	log.Info("Command finished", "args", args, "exit_code", exitCode, "duration_ms", duration.Milliseconds())
+	hookExecutionSeconds.WithLabelValues(hook.Url, strconv.Itoa(exitCode)).Observe(duration.Seconds())
+	return exitCode, false, nil
 }
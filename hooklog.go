@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Package-level hook log settings, set up by initHookLogging from Config.
+var (
+	hookLogDir      string
+	hookLogMaxFiles int
+	hookLogMaxAge   time.Duration
+	hookLogMaxSize  int64
+	logHookOutput   bool
+)
+
+// initHookLogging configures per-hook execution log capture and its
+// retention policy from the HookLogDir, LogHookOutput, HookLogMaxFiles,
+// HookLogMaxAgeDays, and HookLogMaxSizeBytes settings in config.
+func initHookLogging(config *Config) {
+	hookLogDir = config.HookLogDir
+	hookLogMaxFiles = config.HookLogMaxFiles
+	hookLogMaxAge = time.Duration(config.HookLogMaxAgeDays) * 24 * time.Hour
+	hookLogMaxSize = config.HookLogMaxSizeBytes
+	logHookOutput = config.LogHookOutput
+
+	if hookLogDir != "" {
+		if err := os.MkdirAll(hookLogDir, 0755); err != nil {
+			fatalf("Could not create hook log directory %s: %s", hookLogDir, err)
+		}
+	}
+}
+
+// renderLogFile expands hook.LogFile against e and returns the full path
+// under hookLogDir that the execution's output should be appended to. It
+// returns "" if per-hook log files aren't configured. Since LogFile is
+// expanded against attacker-controlled event data, the rendered name is
+// required to stay inside hookLogDir, the same way hookLogHandler guards
+// the read side.
+func (hook *Hook) renderLogFile(e Event) (string, error) {
+	if hookLogDir == "" || hook.logFileTemplate == nil {
+		return "", nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := hook.logFileTemplate.Execute(buf, e); err != nil {
+		return "", err
+	}
+
+	name := buf.String()
+	if name == "" {
+		return "", nil
+	}
+
+	cleanName := filepath.Clean(string(filepath.Separator) + name)
+	path := filepath.Join(hookLogDir, cleanName)
+	if !strings.HasPrefix(path, filepath.Clean(hookLogDir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("rendered log file name %q escapes HookLogDir", name)
+	}
+
+	return path, nil
+}
+
+// openHookLog enforces the retention policy for path's directory and then
+// opens path for appending, creating it if necessary.
+func openHookLog(path string) (*os.File, error) {
+	enforceRetention(filepath.Dir(path))
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// enforceRetention removes the oldest files in dir until it satisfies
+// hookLogMaxFiles, hookLogMaxAge, and hookLogMaxSize. Any of the three
+// limits being zero disables that check.
+func enforceRetention(dir string) {
+	if hookLogMaxFiles <= 0 && hookLogMaxAge <= 0 && hookLogMaxSize <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type logFile struct {
+		path    string
+		modTime time.Time
+		size    int64
+	}
+
+	files := make([]logFile, 0, len(entries))
+	var totalSize int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, logFile{filepath.Join(dir, entry.Name()), info.ModTime(), info.Size()})
+		totalSize += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	now := time.Now()
+	for len(files) > 0 {
+		oldest := files[0]
+		expired := hookLogMaxAge > 0 && now.Sub(oldest.modTime) > hookLogMaxAge
+		tooMany := hookLogMaxFiles > 0 && len(files) > hookLogMaxFiles
+		tooBig := hookLogMaxSize > 0 && totalSize > hookLogMaxSize
+		if !expired && !tooMany && !tooBig {
+			break
+		}
+
+		if err := os.Remove(oldest.path); err == nil {
+			totalSize -= oldest.size
+		}
+		files = files[1:]
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger is the process-wide structured logger, configured by initLogger
+// from Config.LogFormat and Config.LogLevel. It defaults to a text logger
+// at info level so that log lines are still produced if initLogger is
+// never called, e.g. by code exercised before the config is loaded.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// initLogger builds the process-wide logger from the LogFormat ("text" or
+// "json") and LogLevel ("debug", "info", "warn", or "error") settings in
+// config, replacing the default text/info logger.
+func initLogger(config *Config) {
+	level := parseLogLevel(config.LogLevel)
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.ToLower(config.LogFormat) == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	logger = slog.New(handler)
+}
+
+func parseLogLevel(name string) slog.Level {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// fatalf logs a formatted error and exits, mirroring the old glog.Fatalf
+// call sites that expected to terminate the process.
+func fatalf(format string, args ...interface{}) {
+	logger.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// newRequestID generates a short random hex ID used to correlate all log
+// lines produced while handling a single incoming webhook request.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// eventFields extracts the log attributes that are useful for correlating
+// a hook execution back to the event that triggered it.
+func eventFields(e Event) []any {
+	fields := make([]any, 0, 4)
+
+	if eventType, ok := e["type"].(string); ok {
+		fields = append(fields, "event.type", eventType)
+	}
+	if ref, ok := e["ref"].(string); ok {
+		fields = append(fields, "ref", ref)
+	}
+	if commit, ok := e["commit"].(map[string]interface{}); ok {
+		if sha, ok := commit["id"].(string); ok {
+			fields = append(fields, "commit.sha", sha)
+		}
+	}
+
+	return fields
+}
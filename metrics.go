@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "unwebhook_requests_total",
+		Help: "Total incoming webhook requests, by hook, event type, and result.",
+	}, []string{"hook", "event", "result"})
+
+	requestBodyBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "unwebhook_request_body_bytes",
+		Help:    "Size of incoming webhook request bodies, in bytes.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	})
+
+	hookExecutionSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "unwebhook_hook_execution_seconds",
+		Help:    "Duration of hook command executions, by hook and exit status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"hook", "exit"})
+
+	hookQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "unwebhook_hook_queue_depth",
+		Help: "Number of hook jobs currently waiting for a free worker.",
+	})
+
+	commandTimeoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "unwebhook_command_timeouts_total",
+		Help: "Total hook commands killed for exceeding their timeout or at the shutdown deadline.",
+	})
+
+	signatureFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "unwebhook_signature_failures_total",
+		Help: "Total requests rejected for failing signature verification, by scheme.",
+	}, []string{"scheme"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestBodyBytes,
+		hookExecutionSeconds,
+		hookQueueDepth,
+		commandTimeoutsTotal,
+		signatureFailuresTotal,
+	)
+}
+
+// metricsHandler serves /metrics when it's mounted on the main router,
+// because Config.MetricsListenAddress equals Config.ListenAddress.
+func metricsHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
+// setupMetricsServer starts a separate /metrics listener when
+// Config.MetricsListenAddress is set to an address other than
+// Config.ListenAddress, reusing the same AcceptIps filtering as the main
+// webhook listener. It is a no-op when MetricsListenAddress is empty, or
+// equal to ListenAddress, since SetupServer mounts /metrics on the main
+// router in that case instead.
+func setupMetricsServer(config *Config) {
+	if config.MetricsListenAddress == "" || config.MetricsListenAddress == config.ListenAddress {
+		return
+	}
+
+	listener, err := net.Listen("tcp", config.MetricsListenAddress)
+	if err != nil {
+		fatalf("Could not listen for metrics on %s: %s", config.MetricsListenAddress, err)
+	}
+
+	if len(config.AcceptIps) != 0 {
+		listenFilter := NewListenFilter(listener, WhiteList)
+		for _, a := range config.AcceptIps {
+			listenFilter.AddString(a)
+		}
+		listener = listenFilter
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Info("Serving metrics", "address", config.MetricsListenAddress)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error("Metrics server error", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const retryBucket = "retries"
+
+// retryEntry is a single queued retry, persisted to QueueDir when one is
+// configured so retries survive a restart.
+type retryEntry struct {
+	ID          string    `json:"id"`
+	HookURL     string    `json:"hook_url"`
+	Event       Event     `json:"event"`
+	RequestID   string    `json:"request_id"`
+	Attempt     int       `json:"attempt"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+}
+
+// retryQueue holds hook executions that failed and are waiting for their
+// backoff to elapse before being resubmitted to the worker pool.
+type retryQueue struct {
+	mu      sync.Mutex
+	db      *bbolt.DB
+	hooks   map[string]*Hook
+	entries map[string]*retryEntry
+	timers  map[string]*time.Timer
+}
+
+// retryQ is the process-wide retry queue, set up by initRetryQueue once
+// Config.Hook has been loaded.
+var retryQ *retryQueue
+
+// initRetryQueue builds the retry queue and, if Config.QueueDir is set,
+// opens its on-disk store and reloads any retries left over from a
+// previous run.
+func initRetryQueue(config *Config) {
+	rq := &retryQueue{
+		hooks:   make(map[string]*Hook, len(config.Hook)),
+		entries: make(map[string]*retryEntry),
+		timers:  make(map[string]*time.Timer),
+	}
+	for _, h := range config.Hook {
+		rq.hooks[h.Url] = h
+	}
+
+	if config.QueueDir != "" {
+		if err := os.MkdirAll(config.QueueDir, 0755); err != nil {
+			fatalf("Could not create queue directory %s: %s", config.QueueDir, err)
+		}
+
+		db, err := bbolt.Open(filepath.Join(config.QueueDir, "retryqueue.db"), 0600, nil)
+		if err != nil {
+			fatalf("Could not open retry queue database: %s", err)
+		}
+		err = db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(retryBucket))
+			return err
+		})
+		if err != nil {
+			fatalf("Could not prepare retry queue database: %s", err)
+		}
+
+		rq.db = db
+	}
+
+	retryQ = rq
+	retryQ.reload()
+}
+
+// reload reschedules every retry entry persisted in the on-disk store,
+// called once at startup.
+func (rq *retryQueue) reload() {
+	if rq.db == nil {
+		return
+	}
+
+	rq.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(retryBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry retryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				logger.Error("Could not decode persisted retry entry", "id", string(k), "error", err)
+				return nil
+			}
+
+			rq.mu.Lock()
+			rq.entries[entry.ID] = &entry
+			rq.mu.Unlock()
+			rq.scheduleTimer(&entry)
+			return nil
+		})
+	})
+}
+
+// shouldRetry reports whether hook is configured to retry an execution
+// that ended with the given exit code or timeout, and hasn't already used
+// up its MaxRetries attempts.
+func (hook *Hook) shouldRetry(attempt int, exitCode int, timedOut bool) bool {
+	if retryQ == nil || attempt >= hook.MaxRetries {
+		return false
+	}
+
+	for _, cond := range hook.RetryOn {
+		if timedOut && cond == "timeout" {
+			return true
+		}
+		if !timedOut && cond == strconv.Itoa(exitCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// maybeRetry schedules a retry of e through hook if the outcome of the
+// given attempt is one hook.RetryOn names and retries remain.
+func (hook *Hook) maybeRetry(e Event, requestID string, attempt int, exitCode int, timedOut bool, err error) {
+	if !hook.shouldRetry(attempt, exitCode, timedOut) {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("exit code %d", exitCode)
+	}
+	retryQ.schedule(hook, e, requestID, attempt+1, err)
+}
+
+// backoffFor computes the exponential backoff, with jitter, to wait before
+// the given retry attempt (1-based: the first retry is attempt 1).
+func (hook *Hook) backoffFor(attempt int) time.Duration {
+	initial := time.Duration(hook.InitialBackoff) * time.Second
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := time.Duration(hook.MaxBackoff) * time.Second
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+
+	backoff := initial * time.Duration(int64(1)<<uint(attempt-1))
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	return backoff/2 + jitter
+}
+
+// cloneEvent shallow-copies e's top-level keys so a retry entry keeps the
+// event as it was at schedule time. Without this, a PerCommit hook's retry
+// would alias the same map hook.Execute mutates for every subsequent
+// commit, and fire would resubmit whichever commit happened to be current
+// when the timer went off rather than the one the retry was for.
+func cloneEvent(e Event) Event {
+	clone := make(Event, len(e))
+	for k, v := range e {
+		clone[k] = v
+	}
+	return clone
+}
+
+// schedule enqueues a retry of e through hook, waiting for the attempt's
+// backoff to elapse before resubmitting it to the worker pool.
+func (rq *retryQueue) schedule(hook *Hook, e Event, requestID string, attempt int, lastErr error) {
+	backoff := hook.backoffFor(attempt)
+
+	entry := &retryEntry{
+		ID:          fmt.Sprintf("%s-%d-%d", requestID, attempt, time.Now().UnixNano()),
+		HookURL:     hook.Url,
+		Event:       cloneEvent(e),
+		RequestID:   requestID,
+		Attempt:     attempt,
+		NextAttempt: time.Now().Add(backoff),
+		LastError:   lastErr.Error(),
+	}
+
+	rq.mu.Lock()
+	rq.entries[entry.ID] = entry
+	rq.mu.Unlock()
+
+	rq.persist(entry)
+	rq.scheduleTimer(entry)
+
+	logger.Info("Scheduled hook retry", "request_id", requestID, "hook.url", hook.Url,
+		"attempt", attempt, "backoff", backoff.String())
+}
+
+func (rq *retryQueue) scheduleTimer(entry *retryEntry) {
+	delay := time.Until(entry.NextAttempt)
+	if delay < 0 {
+		delay = 0
+	}
+
+	rq.mu.Lock()
+	rq.timers[entry.ID] = time.AfterFunc(delay, func() { rq.fire(entry.ID) })
+	rq.mu.Unlock()
+}
+
+// fire resubmits a due retry entry to the worker pool.
+func (rq *retryQueue) fire(id string) {
+	rq.mu.Lock()
+	entry, ok := rq.entries[id]
+	delete(rq.entries, id)
+	delete(rq.timers, id)
+	rq.mu.Unlock()
+	if !ok {
+		return
+	}
+	rq.removePersisted(id)
+
+	hook, ok := rq.hooks[entry.HookURL]
+	if !ok {
+		logger.Warn("Retry for unknown hook, dropping", "hook.url", entry.HookURL, "id", id)
+		return
+	}
+
+	logger.Info("Retrying hook", "hook.url", hook.Url, "request_id", entry.RequestID, "attempt", entry.Attempt)
+	job := hookJob{hook: hook, event: entry.Event, requestID: entry.RequestID, queuedAt: time.Now(), attempt: entry.Attempt}
+	if !pool.submit(job) {
+		logger.Warn("Queue full, dropping retry", "hook.url", hook.Url, "id", id)
+	}
+}
+
+func (rq *retryQueue) persist(entry *retryEntry) {
+	if rq.db == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Could not encode retry entry", "id", entry.ID, "error", err)
+		return
+	}
+	err = rq.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(retryBucket)).Put([]byte(entry.ID), data)
+	})
+	if err != nil {
+		logger.Error("Could not persist retry entry", "id", entry.ID, "error", err)
+	}
+}
+
+func (rq *retryQueue) removePersisted(id string) {
+	if rq.db == nil {
+		return
+	}
+	rq.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(retryBucket)).Delete([]byte(id))
+	})
+}
+
+// list returns a snapshot of all pending retry entries, for GET /queue.
+func (rq *retryQueue) list() []*retryEntry {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	out := make([]*retryEntry, 0, len(rq.entries))
+	for _, entry := range rq.entries {
+		out = append(out, entry)
+	}
+	return out
+}
+
+// retryNow cancels id's backoff timer and resubmits it immediately.
+func (rq *retryQueue) retryNow(id string) bool {
+	rq.mu.Lock()
+	timer, ok := rq.timers[id]
+	rq.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	timer.Stop()
+	go rq.fire(id)
+	return true
+}
+
+// cancel removes a pending retry entry without ever running it.
+func (rq *retryQueue) cancel(id string) bool {
+	rq.mu.Lock()
+	timer, ok := rq.timers[id]
+	delete(rq.entries, id)
+	delete(rq.timers, id)
+	rq.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	timer.Stop()
+	rq.removePersisted(id)
+	return true
+}
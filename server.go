@@ -2,17 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"github.com/dimfeld/glog"
 	"github.com/dimfeld/httptreemux"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type HookHandler func(http.ResponseWriter, *http.Request, map[string]string, *Hook)
 
 func hookHandler(w http.ResponseWriter, r *http.Request, params map[string]string, hook *Hook) {
 	gitlabEventType := r.Header.Get("X-Gitlab-Event")
+	requestID := newRequestID()
+	log := logger.With("request_id", requestID, "hook.url", hook.Url)
 
 	if r.ContentLength > 16384 {
 		// We should never get a request this large.
@@ -23,59 +31,140 @@ func hookHandler(w http.ResponseWriter, r *http.Request, params map[string]strin
 	buffer := bytes.Buffer{}
 	buffer.ReadFrom(r.Body)
 	r.Body.Close()
+	requestBodyBytes.Observe(float64(buffer.Len()))
 
-	if glog.V(2) {
+	if log.Enabled(context.Background(), slog.LevelDebug) {
 		niceBuffer := &bytes.Buffer{}
 		json.Indent(niceBuffer, buffer.Bytes(), "", "  ")
-		glog.Infof("Hook %s received data %s\n",
-			r.URL.Path, string(niceBuffer.Bytes()))
+		log.Debug("Hook received data", "body", niceBuffer.String())
 	}
 
 	if hook.Secret != "" {
-		if r.Header.Get("X-Gitlab-Token") != "" {
-			secret := r.Header.Get("X-Gitlab-Token")
-			if secret != hook.Secret {
-				glog.Warningf("Request with bad secret for hook %s from %s [%s]",
-					r.URL.Path, r.RemoteAddr, secret)
+		if err := verifySignature(hook, r, buffer.Bytes()); err != nil {
+			scheme := hook.SignatureScheme
+			if scheme == "" {
+				scheme = SignatureGitlabToken
+			}
+			log.Warn("Request failed verification",
+				"scheme", scheme, "remote_addr", r.RemoteAddr, "error", err)
+			signatureFailuresTotal.WithLabelValues(scheme).Inc()
+			requestsTotal.WithLabelValues(hook.Url, gitlabEventType, "rejected").Inc()
+			if scheme == SignatureBitbucketJWT {
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
 				w.WriteHeader(http.StatusForbidden)
-				return
 			}
-		} else {
-			glog.Warningf("Request with no secret for hook %s from %s\n",
-				r.URL.Path, r.RemoteAddr)
-			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 	}
 
 	event, err := NewEvent(buffer.Bytes(), gitlabEventType)
 	if err != nil {
-		glog.Errorf("Error parinsg JSON for %s: %s", r.URL.Path, err)
+		log.Error("Error parsing JSON", "error", err)
+		requestsTotal.WithLabelValues(hook.Url, gitlabEventType, "error").Inc()
 		return
 	}
 	event["urlparams"] = params
-	go hook.Execute(event)
+
+	job := hookJob{hook: hook, event: event, requestID: requestID, queuedAt: time.Now()}
+	if !pool.submit(job) {
+		log.Warn("Hook queue full, rejecting request")
+		requestsTotal.WithLabelValues(hook.Url, gitlabEventType, "queue_full").Inc()
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	requestsTotal.WithLabelValues(hook.Url, gitlabEventType, "queued").Inc()
 }
 
 func handlerWrapper(handler HookHandler, hook *Hook) httptreemux.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		glog.Infoln("Called", r.URL.Path)
+		logger.Info("Called", "path", r.URL.Path)
 		handler(w, r, params, hook)
 	}
 }
 
+// hookLogHandler streams a previously captured hook execution log back to
+// the caller. params["id"] is the log file's name under hookLogDir, as
+// produced by Hook.LogFile; params["hook"] identifies which hook it
+// belongs to and is only used for logging here, since log files already
+// carry enough of the event in their name to avoid collisions.
+func hookLogHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if hookLogDir == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	cleanID := filepath.Clean(string(filepath.Separator) + params["id"])
+	path := filepath.Join(hookLogDir, cleanID)
+	if !strings.HasPrefix(path, filepath.Clean(hookLogDir)+string(filepath.Separator)) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Warn("Requested hook log not found", "hook", params["hook"], "id", params["id"], "error", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, f)
+}
+
+// queueListHandler reports the hook executions currently waiting on a
+// retry backoff.
+func queueListHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retryQ.list())
+}
+
+// queueRetryHandler cancels a pending retry's backoff and resubmits it to
+// the worker pool immediately.
+func queueRetryHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !retryQ.retryNow(params["id"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// queueDeleteHandler cancels a pending retry without ever running it.
+func queueDeleteHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !retryQ.cancel(params["id"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pool dispatches queued hook executions to a bounded set of workers. It is
+// created by initWorkerPool from Config.NbWorkers and Config.QueueSize,
+// before anything that might submit a job to it.
+var pool *workerPool
+
+// initWorkerPool creates the worker pool. It must run before initRetryQueue,
+// since reloading a persisted retry queue can submit jobs to pool almost
+// immediately for entries whose backoff has already elapsed.
+func initWorkerPool(config *Config) {
+	pool = newWorkerPool(config.NbWorkers, config.QueueSize)
+}
+
 func SetupServer(config *Config) (net.Listener, http.Handler) {
 	var listener net.Listener = nil
 
 	listener, err := net.Listen("tcp", config.ListenAddress)
 	if err != nil {
-		glog.Fatalf("Could not listen on %s: %s\n", config.ListenAddress, err)
+		fatalf("Could not listen on %s: %s", config.ListenAddress, err)
 	}
 
 	if len(config.AcceptIps) != 0 {
 		listenFilter := NewListenFilter(listener, WhiteList)
 		for _, a := range config.AcceptIps {
-			glog.Infoln("Adding IP filter", a)
+			logger.Info("Adding IP filter", "ip", a)
 			listenFilter.AddString(a)
 		}
 		listener = listenFilter
@@ -87,10 +176,25 @@ func SetupServer(config *Config) (net.Listener, http.Handler) {
 		router.POST(hook.Url, handlerWrapper(hookHandler, hook))
 	}
 
+	router.GET("/logs/:hook/:id", hookLogHandler)
+
+	router.GET("/queue", queueListHandler)
+	router.POST("/queue/:id/retry", queueRetryHandler)
+	router.DELETE("/queue/:id", queueDeleteHandler)
+
+	if config.MetricsListenAddress != "" && config.MetricsListenAddress == config.ListenAddress {
+		router.GET("/metrics", metricsHandler)
+	}
+
 	return listener, router
 }
 
 func RunServer(config *Config) {
+	setupMetricsServer(config)
+
 	listener, router := SetupServer(config)
-	glog.Fatal(http.Serve(listener, router))
+	srv := &http.Server{Handler: router}
+	shutdownTimeout := time.Duration(config.ShutdownTimeout) * time.Second
+
+	runGracefully(srv, listener, shutdownTimeout)
 }
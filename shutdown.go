@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// inFlight tracks hook executions that have been submitted to the worker
+// pool, whether still queued or already running, so that runGracefully can
+// wait for them to finish before the process exits.
+var inFlight sync.WaitGroup
+
+// killCtx is canceled once the shutdown grace period elapses without all
+// in-flight hook executions finishing. Executors select on it to kill
+// their running command early rather than let shutdown hang forever.
+var killCtx, cancelKill = context.WithCancel(context.Background())
+
+// runGracefully serves srv on listener until SIGINT or SIGTERM, then stops
+// accepting new connections and waits up to shutdownTimeout for in-flight
+// hook executions to finish, killing them if the deadline passes.
+func runGracefully(srv *http.Server, listener net.Listener, shutdownTimeout time.Duration) {
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(listener) }()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			fatalf("Server error: %s", err)
+		}
+		return
+	case sig := <-sig:
+		logger.Info("Received signal, shutting down", "signal", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Error shutting down HTTP server", "error", err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		logger.Info("All hook executions finished")
+	case <-ctx.Done():
+		logger.Warn("Shutdown timeout reached, killing in-flight hook commands")
+		cancelKill()
+		<-drained
+	}
+}
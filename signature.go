@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Signature schemes supported by the SignatureScheme field on Hook.
+const (
+	SignatureGitlabToken  = "gitlab-token"
+	SignatureGithubSHA256 = "github-hmac-sha256"
+	SignatureGithubSHA1   = "github-hmac-sha1"
+	SignatureGitea        = "gitea"
+	SignatureBitbucketJWT = "bitbucket-jwt"
+)
+
+// verifySignature checks the request against the hook's configured secret,
+// using the verification scheme named in hook.SignatureScheme. body must be
+// the raw, unparsed request body, since HMAC schemes sign the exact bytes
+// that were sent.
+func verifySignature(hook *Hook, r *http.Request, body []byte) error {
+	scheme := hook.SignatureScheme
+	if scheme == "" {
+		scheme = SignatureGitlabToken
+	}
+
+	switch scheme {
+	case SignatureGitlabToken:
+		return verifyGitlabToken(hook, r)
+	case SignatureGithubSHA256:
+		return verifyHMACHeader(hook, r.Header.Get("X-Hub-Signature-256"), "sha256=", sha256.New, body)
+	case SignatureGithubSHA1:
+		return verifyHMACHeader(hook, r.Header.Get("X-Hub-Signature"), "sha1=", sha1.New, body)
+	case SignatureGitea:
+		return verifyHMACHeader(hook, r.Header.Get("X-Gitea-Signature"), "", sha256.New, body)
+	case SignatureBitbucketJWT:
+		return verifyBearerJWT(hook, r.Header.Get("Authorization"))
+	default:
+		return fmt.Errorf("unknown signature scheme %q", scheme)
+	}
+}
+
+func verifyGitlabToken(hook *Hook, r *http.Request) error {
+	secret := r.Header.Get("X-Gitlab-Token")
+	if secret == "" {
+		return fmt.Errorf("no token in request")
+	}
+	if !hmac.Equal([]byte(secret), []byte(hook.Secret)) {
+		return fmt.Errorf("token mismatch")
+	}
+	return nil
+}
+
+func verifyHMACHeader(hook *Hook, header string, prefix string, newHash func() hash.Hash, body []byte) error {
+	if header == "" {
+		return fmt.Errorf("no signature in request")
+	}
+
+	signature := header
+	if prefix != "" {
+		if !strings.HasPrefix(header, prefix) {
+			return fmt.Errorf("signature missing %q prefix", prefix)
+		}
+		signature = header[len(prefix):]
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %s", err)
+	}
+
+	mac := hmac.New(newHash, []byte(hook.Secret))
+	mac.Write(body)
+	computed := mac.Sum(nil)
+
+	if !hmac.Equal(expected, computed) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// verifyBearerJWT verifies the HMAC-SHA256 signature and expiry of a JWT
+// passed in an "Authorization: Bearer <token>" header, as used by
+// Bitbucket Server's webhook signing.
+func verifyBearerJWT(hook *Hook, authHeader string) error {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(authHeader, prefix) {
+		return fmt.Errorf("no bearer token in request")
+	}
+	token := authHeader[len(prefix):]
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed JWT signature: %s", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("JWT signature mismatch")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed JWT payload: %s", err)
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed JWT claims: %s", err)
+	}
+	if claims.Exp != 0 && time.Now().Unix() > claims.Exp {
+		return fmt.Errorf("JWT expired")
+	}
+
+	return nil
+}
@@ -4,10 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"github.com/dimfeld/glog"
 	"github.com/dimfeld/goconfig"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"text/template"
 )
@@ -49,9 +47,63 @@ type Hook struct {
 	// this hook by setting the hook's secret to "none".
 	Secret string
 
-	cmdTemplate [][]*template.Template
-	envTemplate []*template.Template
-	dirTemplate *template.Template
+	// SignatureScheme selects how Secret is verified against the incoming
+	// request. One of "gitlab-token" (default), "github-hmac-sha256",
+	// "github-hmac-sha1", "gitea", or "bitbucket-jwt". See verifySignature
+	// for the details of each scheme.
+	SignatureScheme string
+
+	// LogFile is a template, expanded against the event, that names the
+	// file under Config.HookLogDir that this execution's combined
+	// stdout/stderr is appended to, e.g. "{{.repository.name}}-{{.commit.id}}.log".
+	// If Config.HookLogDir is unset, command output goes to the server log
+	// as before.
+	LogFile string
+
+	// Executor selects where Commands run: "local" (default), "docker", or
+	// "ssh". See the Executor interface for what each one does.
+	Executor string
+
+	// Image is the image to run Commands in when Executor is "docker".
+	Image string
+	// Volumes are bind mounts, in "host:container" form, passed to
+	// `docker run -v` when Executor is "docker".
+	Volumes []string
+	// Network is passed to `docker run --network` when Executor is "docker".
+	Network string
+
+	// Host, User, and KeyFile configure the remote connection when
+	// Executor is "ssh". Host includes the port, e.g. "example.com:22".
+	Host    string
+	User    string
+	KeyFile string
+
+	// HostKeyFile is a known_hosts file, in the usual OpenSSH format (as
+	// produced by ssh-keyscan or already present at ~/.ssh/known_hosts),
+	// used to verify Host's key when Executor is "ssh". Required: a
+	// connection to a host missing from the file, or present with a
+	// different key, is refused rather than allowed through unverified.
+	HostKeyFile string
+
+	// MaxRetries is how many additional times a failed execution is
+	// retried. Defaults to 0, meaning no retries.
+	MaxRetries int
+
+	// RetryOn lists the outcomes that trigger a retry: exit codes as
+	// strings, e.g. "1", and/or "timeout". An outcome not listed here is
+	// never retried, however MaxRetries is set.
+	RetryOn []string
+
+	// InitialBackoff and MaxBackoff bound the exponential backoff, in
+	// seconds, applied between retries. InitialBackoff defaults to 1 and
+	// MaxBackoff to 300.
+	InitialBackoff int
+	MaxBackoff     int
+
+	cmdTemplate     [][]*template.Template
+	envTemplate     []*template.Template
+	dirTemplate     *template.Template
+	logFileTemplate *template.Template
 }
 
 type Hooks struct {
@@ -61,7 +113,13 @@ type Hooks struct {
 type Config struct {
 	ListenAddress string
 
-	LogDir string
+	// LogFormat selects the structured logger's output format: "text"
+	// (default) or "json".
+	LogFormat string
+
+	// LogLevel selects the structured logger's minimum level: "debug",
+	// "info" (default), "warn", or "error".
+	LogLevel string
 
 	// The maximum amount of time to wait for a command to finish.
 	// Default is 5 seconds.
@@ -73,6 +131,48 @@ type Config struct {
 	// Default secret required in requests. See the Hook struct for more description.
 	Secret string
 
+	// NbWorkers is the number of worker goroutines that execute queued
+	// hooks. Defaults to 4.
+	NbWorkers int
+
+	// QueueSize is the maximum number of hook executions that may be
+	// waiting for a free worker at once. Requests received while the
+	// queue is full are rejected with a 503. Defaults to 100.
+	QueueSize int
+
+	// HookLogDir is the directory that per-hook execution logs (see
+	// Hook.LogFile) are written to. If empty, hook output goes to the
+	// server log instead.
+	HookLogDir string
+
+	// LogHookOutput also tees each hook execution's output to the server
+	// log, even when it's being captured to a file under HookLogDir.
+	LogHookOutput bool
+
+	// HookLogMaxFiles, HookLogMaxAgeDays, and HookLogMaxSizeBytes bound the
+	// retention of files in HookLogDir; the oldest files are removed first.
+	// Any of the three left at zero disables that check.
+	HookLogMaxFiles     int
+	HookLogMaxAgeDays   int
+	HookLogMaxSizeBytes int64
+
+	// MetricsListenAddress, if set, serves Prometheus metrics on /metrics
+	// at this address. If it equals ListenAddress, /metrics is mounted on
+	// the main router instead of opening a second listener; otherwise a
+	// separate listener is opened for it. AcceptIps filtering applies to
+	// it either way. Metrics are not served at all if this is left empty.
+	MetricsListenAddress string
+
+	// ShutdownTimeout is how long to wait, in seconds, for in-flight hook
+	// executions to finish after SIGINT/SIGTERM before killing them.
+	// Defaults to 30 seconds.
+	ShutdownTimeout int
+
+	// QueueDir, if set, persists the retry queue (see Hook.MaxRetries) to
+	// a BoltDB file in this directory so retries survive a restart. If
+	// empty, retries are kept in memory only.
+	QueueDir string
+
 	// Paths to search for hook files
 	HookPaths []string
 
@@ -95,17 +195,17 @@ func (c *Config) AddHookFile(file string) {
 	} else {
 		f, err = os.Open(file)
 		if err != nil {
-			glog.Fatalf("Error loading %s: %s", file, err)
+			fatalf("Error loading %s: %s", file, err)
 			return
 		}
 		defer f.Close()
 	}
 
-	glog.Infoln("Reading hooks from", file)
+	logger.Info("Reading hooks from", "file", file)
 
 	_, err = toml.DecodeReader(f, h)
 	if err != nil {
-		glog.Fatalf("Error loading %s: %s", file, err)
+		fatalf("Error loading %s: %s", file, err)
 		return
 	}
 
@@ -115,7 +215,7 @@ func (c *Config) AddHookFile(file string) {
 func (c *Config) AddHookPath(p string) {
 	info, err := os.Stat(p)
 	if err != nil {
-		glog.Fatalf("Error loading %s: %s", p, err)
+		fatalf("Error loading %s: %s", p, err)
 		return
 	}
 
@@ -123,7 +223,7 @@ func (c *Config) AddHookPath(p string) {
 		filepath.Walk(p,
 			func(path string, info os.FileInfo, err error) error {
 				if err != nil {
-					glog.Fatalf("Error loading %s, %s", path, err)
+					fatalf("Error loading %s, %s", path, err)
 					return err
 				}
 				if info.IsDir() {
@@ -138,34 +238,14 @@ func (c *Config) AddHookPath(p string) {
 	}
 }
 
-func catchSIGINT(f func(), quit bool) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for _ = range c {
-			glog.Info("SIGINT received...")
-			f()
-			if quit {
-				os.Exit(1)
-			}
-		}
-	}()
-}
-
-func isDirectory(dirPath string) bool {
-	stat, err := os.Stat(dirPath)
-	if err != nil || !stat.IsDir() {
-		return false
-	}
-	return true
-}
-
 func main() {
 	flag.Parse()
 
 	config := &Config{
 		ListenAddress:  ":80",
 		CommandTimeout: 5,
+		NbWorkers:      defaultNbWorkers,
+		QueueSize:      defaultQueueSize,
 	}
 
 	mainConfigPath := os.Getenv("UNWEBHOOK_CONFFILE")
@@ -199,22 +279,8 @@ func main() {
 		}
 	}
 
-	// Use config.LogDir if not given on the command line.
-	dir := flag.CommandLine.Lookup("log_dir")
-	if dir != nil && dir.Value.String() == "" {
-		if config.LogDir == "" {
-			config.LogDir = "."
-		}
-		flag.Set("log_dir", config.LogDir)
-
-		if !isDirectory(config.LogDir) {
-			err := os.MkdirAll(config.LogDir, 0755)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to create log directory: %s\n", err)
-				fmt.Fprintf(os.Stderr, "Logs will go to $TMPDIR\n")
-			}
-		}
-	}
+	initLogger(config)
+	initHookLogging(config)
 
 	for _, h := range config.HookPaths {
 		config.AddHookPath(h)
@@ -226,15 +292,9 @@ func main() {
 		}
 	}
 
-	closer := func() {
-		glog.Flush()
-	}
-	catchSIGINT(closer, true)
-	defer closer()
-
 	failed := false
 	for _, h := range config.Hook {
-		glog.Infoln("Loading hook", h.Url)
+		logger.Info("Loading hook", "hook.url", h.Url)
 
 		if h.Timeout == 0 {
 			h.Timeout = config.CommandTimeout
@@ -248,7 +308,7 @@ func main() {
 
 		err := h.CreateTemplates()
 		if err != nil {
-			glog.Errorf("Failed parsing template %s: %s", h.Url, err)
+			logger.Error("Failed parsing template", "hook.url", h.Url, "error", err)
 			failed = true
 		}
 	}
@@ -257,5 +317,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	initWorkerPool(config)
+	initRetryQueue(config)
+
 	RunServer(config)
 }
@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+// defaultNbWorkers and defaultQueueSize are used when Config.NbWorkers or
+// Config.QueueSize are left at zero.
+const (
+	defaultNbWorkers = 4
+	defaultQueueSize = 100
+)
+
+// hookJob is a single queued hook invocation, carrying everything a worker
+// needs to run it and log it.
+type hookJob struct {
+	hook      *Hook
+	event     Event
+	requestID string
+	queuedAt  time.Time
+	// attempt is 0 for a fresh request and counts up each time retryQueue
+	// resubmits the job after a failure.
+	attempt int
+}
+
+// workerPool dispatches hookJobs to a fixed number of worker goroutines
+// through a bounded channel, so that a burst of webhooks can't fork-bomb
+// the host the way unbounded `go hook.Execute` did.
+type workerPool struct {
+	jobs chan hookJob
+}
+
+// newWorkerPool starts numWorkers goroutines reading from a channel of the
+// given size and returns the pool used to submit jobs to them.
+func newWorkerPool(numWorkers, queueSize int) *workerPool {
+	if numWorkers <= 0 {
+		numWorkers = defaultNbWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	p := &workerPool{jobs: make(chan hookJob, queueSize)}
+	for i := 0; i < numWorkers; i++ {
+		go p.worker(i)
+	}
+	return p
+}
+
+func (p *workerPool) worker(id int) {
+	for j := range p.jobs {
+		hookQueueDepth.Set(float64(len(p.jobs)))
+		logger.Debug("Dequeued hook job",
+			"request_id", j.requestID, "hook.url", j.hook.Url,
+			"worker", id, "queue_wait_ms", time.Since(j.queuedAt).Milliseconds())
+
+		j.hook.Execute(killCtx, j.event, j.requestID, j.attempt)
+		inFlight.Done()
+	}
+}
+
+// submit enqueues a job without blocking, reporting false if the queue is
+// full so the caller can reject the request instead of piling up work. j
+// counts against inFlight from the moment it's accepted here, not just
+// while a worker is running it, so that graceful shutdown also waits for
+// jobs still sitting in the channel rather than just the ones already
+// dequeued.
+func (p *workerPool) submit(j hookJob) bool {
+	inFlight.Add(1)
+	select {
+	case p.jobs <- j:
+		hookQueueDepth.Set(float64(len(p.jobs)))
+		return true
+	default:
+		inFlight.Done()
+		return false
+	}
+}